@@ -23,38 +23,87 @@ import (
 	"github.com/wealdtech/ethdo/services/chaintime"
 )
 
-// AttestationHead returns the head for which the attestation should have voted.
-func AttestationHead(ctx context.Context,
+// ErrNoCanonicalAncestor is returned by the backwards canonical-chain walks in this
+// file when they reach genesis without finding a canonical ancestor. It is distinct
+// from a fetch error, which indicates a transient failure rather than an exhausted
+// search range.
+var ErrNoCanonicalAncestor = errors.New("no canonical ancestor found before reaching genesis")
+
+// canonicalAncestor walks canonical blocks backwards from slot, down to genesis,
+// returning the first canonical block whose root satisfies match. If match is
+// nil, the first canonical block found satisfies it. ok is false if genesis is
+// reached without a match; this is a legitimate "not found" that callers can
+// tell apart from a fetch error, rather than an error in its own right. This is
+// the primitive shared by canonicalRootAtOrBefore (AttestationHead,
+// AttestationTarget, AttestationSource) and ScoreAttestationData's
+// canonicalSlotForRoot.
+func canonicalAncestor(ctx context.Context,
 	headersCache *BeaconBlockHeaderCache,
-	attestation *spec.VersionedAttestation,
+	slot phase0.Slot,
+	match func(phase0.Root) bool,
 ) (
 	phase0.Root,
+	phase0.Slot,
+	bool,
 	error,
 ) {
-	attestationData, err := attestation.Data()
-	if err != nil {
-		return phase0.Root{}, errors.Wrap(err, "failed to obtain attestation data")
-	}
-
-	slot := attestationData.Slot
 	for {
+		if err := ctx.Err(); err != nil {
+			return phase0.Root{}, 0, false, err
+		}
+
 		header, err := headersCache.Fetch(ctx, slot)
 		if err != nil {
-			return phase0.Root{}, err
+			return phase0.Root{}, 0, false, err
 		}
-		if header == nil {
-			// No block.
-			slot--
-			continue
+		if header != nil && header.Canonical && (match == nil || match(header.Root)) {
+			return header.Root, slot, true, nil
 		}
-		if !header.Canonical {
-			// Not canonical.
-			slot--
-			continue
+
+		// No matching canonical block at this slot; move to the previous one,
+		// unless we have reached genesis and cannot go any further back.
+		if slot == 0 {
+			return phase0.Root{}, 0, false, nil
 		}
+		slot--
+	}
+}
 
-		return header.Root, nil
+// canonicalRootAtOrBefore walks canonical blocks backwards from the given slot,
+// returning the root of the first canonical block found. This is the primitive
+// shared by AttestationHead, AttestationTarget and AttestationSource.
+func canonicalRootAtOrBefore(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	slot phase0.Slot,
+) (
+	phase0.Root,
+	error,
+) {
+	root, _, ok, err := canonicalAncestor(ctx, headersCache, slot, nil)
+	if err != nil {
+		return phase0.Root{}, err
+	}
+	if !ok {
+		return phase0.Root{}, ErrNoCanonicalAncestor
 	}
+
+	return root, nil
+}
+
+// AttestationHead returns the head for which the attestation should have voted.
+func AttestationHead(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	attestation *spec.VersionedAttestation,
+) (
+	phase0.Root,
+	error,
+) {
+	attestationData, err := attestation.Data()
+	if err != nil {
+		return phase0.Root{}, errors.Wrap(err, "failed to obtain attestation data")
+	}
+
+	return canonicalRootAtOrBefore(ctx, headersCache, attestationData.Slot)
 }
 
 // AttestationHeadCorrect returns true if the given attestation had the correct head.
@@ -70,25 +119,12 @@ func AttestationHeadCorrect(ctx context.Context,
 		return false, errors.Wrap(err, "failed to obtain attestation data")
 	}
 
-	slot := attestationData.Slot
-	for {
-		header, err := headersCache.Fetch(ctx, slot)
-		if err != nil {
-			return false, err
-		}
-		if header == nil {
-			// No block.
-			slot--
-			continue
-		}
-		if !header.Canonical {
-			// Not canonical.
-			slot--
-			continue
-		}
-
-		return bytes.Equal(header.Root[:], attestationData.BeaconBlockRoot[:]), nil
+	head, err := AttestationHead(ctx, headersCache, attestation)
+	if err != nil {
+		return false, err
 	}
+
+	return bytes.Equal(head[:], attestationData.BeaconBlockRoot[:]), nil
 }
 
 // AttestationTarget returns the target for which the attestation should have voted.
@@ -107,24 +143,8 @@ func AttestationTarget(ctx context.Context,
 
 	// Start with first slot of the target epoch.
 	slot := chainTime.FirstSlotOfEpoch(attestationData.Target.Epoch)
-	for {
-		header, err := headersCache.Fetch(ctx, slot)
-		if err != nil {
-			return phase0.Root{}, err
-		}
-		if header == nil {
-			// No block.
-			slot--
-			continue
-		}
-		if !header.Canonical {
-			// Not canonical.
-			slot--
-			continue
-		}
 
-		return header.Root, nil
-	}
+	return canonicalRootAtOrBefore(ctx, headersCache, slot)
 }
 
 // AttestationTargetCorrect returns true if the given attestation had the correct target.
@@ -141,24 +161,134 @@ func AttestationTargetCorrect(ctx context.Context,
 		return false, errors.Wrap(err, "failed to obtain attestation data")
 	}
 
-	// Start with first slot of the target epoch.
-	slot := chainTime.FirstSlotOfEpoch(attestationData.Target.Epoch)
-	for {
+	target, err := AttestationTarget(ctx, headersCache, chainTime, attestation)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(target[:], attestationData.Target.Root[:]), nil
+}
+
+// AttestationSource returns the source for which the attestation should have voted.
+func AttestationSource(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	chainTime chaintime.Service,
+	attestation *spec.VersionedAttestation,
+) (
+	phase0.Root,
+	error,
+) {
+	attestationData, err := attestation.Data()
+	if err != nil {
+		return phase0.Root{}, errors.Wrap(err, "failed to obtain attestation data")
+	}
+
+	// Start with first slot of the source epoch.
+	slot := chainTime.FirstSlotOfEpoch(attestationData.Source.Epoch)
+
+	return canonicalRootAtOrBefore(ctx, headersCache, slot)
+}
+
+// AttestationSourceCorrect returns true if the given attestation had the correct source.
+func AttestationSourceCorrect(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	chainTime chaintime.Service,
+	attestation *spec.VersionedAttestation,
+) (
+	bool,
+	error,
+) {
+	attestationData, err := attestation.Data()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to obtain attestation data")
+	}
+
+	source, err := AttestationSource(ctx, headersCache, chainTime, attestation)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(source[:], attestationData.Source.Root[:]), nil
+}
+
+// AttestationNotIncluded is returned by AttestationInclusionDistance when the attestation
+// has not (yet) been included in any canonical block known to the cache.
+const AttestationNotIncluded = -1
+
+// AttestationInclusionDistance returns the number of slots between an attestation's slot
+// and the slot of the canonical block that first included it, or AttestationNotIncluded
+// if no such block has been found.
+func AttestationInclusionDistance(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	bodiesCache *BeaconBlockBodyCache,
+	chainTime chaintime.Service,
+	attestation *spec.VersionedAttestation,
+) (
+	int,
+	error,
+) {
+	attestationData, err := attestation.Data()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to obtain attestation data")
+	}
+
+	currentSlot := chainTime.CurrentSlot()
+	for slot := attestationData.Slot + 1; slot <= currentSlot; slot++ {
 		header, err := headersCache.Fetch(ctx, slot)
 		if err != nil {
-			return false, err
+			return 0, err
 		}
-		if header == nil {
-			// No block.
-			slot--
+		if header == nil || !header.Canonical {
+			// No canonical block at this slot; it cannot include the attestation.
 			continue
 		}
-		if !header.Canonical {
-			// Not canonical.
-			slot--
+
+		body, err := bodiesCache.Fetch(ctx, slot)
+		if err != nil {
+			return 0, err
+		}
+		if body == nil {
 			continue
 		}
 
-		return bytes.Equal(header.Root[:], attestationData.Target.Root[:]), nil
+		included, err := bodyIncludesAttestation(body, attestationData)
+		if err != nil {
+			return 0, err
+		}
+		if included {
+			return int(slot - attestationData.Slot), nil
+		}
 	}
+
+	return AttestationNotIncluded, nil
+}
+
+// bodyIncludesAttestation returns true if the given block body carries an attestation
+// with the same slot, committee index and beacon block root as the supplied attestation
+// data. Source and target are not compared.
+func bodyIncludesAttestation(body *spec.VersionedSignedBeaconBlock, attestationData *phase0.AttestationData) (bool, error) {
+	attestations, err := body.Attestations()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to obtain block attestations")
+	}
+
+	for _, candidate := range attestations {
+		candidateData, err := candidate.Data()
+		if err != nil {
+			return false, errors.Wrap(err, "failed to obtain candidate attestation data")
+		}
+		if candidateData.Slot != attestationData.Slot {
+			continue
+		}
+		if candidateData.Index != attestationData.Index {
+			continue
+		}
+		if !bytes.Equal(candidateData.BeaconBlockRoot[:], attestationData.BeaconBlockRoot[:]) {
+			continue
+		}
+
+		return true, nil
+	}
+
+	return false, nil
 }
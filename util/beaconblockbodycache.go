@@ -0,0 +1,80 @@
+// Copyright © 2022 Weald Technology Trading.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	consensusclient "github.com/attestantio/go-eth2-client"
+	"github.com/attestantio/go-eth2-client/api"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/pkg/errors"
+)
+
+// BeaconBlockBodyCache is a cache of beacon block bodies, keyed by slot, used to avoid
+// repeated fetches when scanning ranges of slots for attestation inclusion.
+type BeaconBlockBodyCache struct {
+	mu     sync.Mutex
+	blocks map[phase0.Slot]*spec.VersionedSignedBeaconBlock
+
+	signedBeaconBlockProvider consensusclient.SignedBeaconBlockProvider
+}
+
+// NewBeaconBlockBodyCache creates a new beacon block body cache.
+func NewBeaconBlockBodyCache(signedBeaconBlockProvider consensusclient.SignedBeaconBlockProvider) *BeaconBlockBodyCache {
+	return &BeaconBlockBodyCache{
+		blocks:                    make(map[phase0.Slot]*spec.VersionedSignedBeaconBlock),
+		signedBeaconBlockProvider: signedBeaconBlockProvider,
+	}
+}
+
+// Fetch fetches the block body for the given slot, using the cache if possible.
+// It returns nil if there is no block at the given slot.
+func (c *BeaconBlockBodyCache) Fetch(ctx context.Context, slot phase0.Slot) (*spec.VersionedSignedBeaconBlock, error) {
+	c.mu.Lock()
+	block, exists := c.blocks[slot]
+	c.mu.Unlock()
+	if exists {
+		return block, nil
+	}
+
+	// Deliberately not held across the network call below, so that concurrent
+	// fetches for different slots (as used by EvaluateAttestations' prefetch
+	// worker pool) can actually run in parallel rather than serializing on c.mu.
+	response, err := c.signedBeaconBlockProvider.SignedBeaconBlock(ctx, &api.SignedBeaconBlockOpts{
+		Block: fmt.Sprintf("%d", slot),
+	})
+	if err != nil {
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+			// No block at this slot.
+			c.mu.Lock()
+			c.blocks[slot] = nil
+			c.mu.Unlock()
+
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "failed to obtain signed beacon block")
+	}
+
+	c.mu.Lock()
+	c.blocks[slot] = response.Data
+	c.mu.Unlock()
+
+	return response.Data, nil
+}
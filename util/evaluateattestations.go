@@ -0,0 +1,351 @@
+// Copyright © 2022 Weald Technology Trading.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/pkg/errors"
+	"github.com/wealdtech/ethdo/services/chaintime"
+)
+
+// headerPrefetchWorkers bounds the number of concurrent fetches carried out by
+// EvaluateAttestations when warming the cache for a batch of attestations.
+const headerPrefetchWorkers = 16
+
+// AttestationEvaluation is the result of evaluating a single attestation against
+// the canonical chain.
+type AttestationEvaluation struct {
+	HeadCorrect    bool
+	TargetCorrect  bool
+	SourceCorrect  bool
+	InclusionDelay int
+}
+
+// EvaluateAttestations evaluates a batch of attestations for head, target and source
+// correctness, and inclusion delay, prefetching the required range of block headers
+// and bodies concurrently. Inclusion delay is computed from the prefetched bodies alone.
+// Head, target and source are computed from the prefetched headers, except where no
+// canonical block lies within the prefetched range at or before the slot in question;
+// a live backwards walk through headersCache is then made, which can fetch headers.
+func EvaluateAttestations(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	bodiesCache *BeaconBlockBodyCache,
+	chainTime chaintime.Service,
+	attestations []*spec.VersionedAttestation,
+) (
+	[]AttestationEvaluation,
+	error,
+) {
+	if len(attestations) == 0 {
+		return []AttestationEvaluation{}, nil
+	}
+
+	datas := make([]*phase0.AttestationData, len(attestations))
+	for i, attestation := range attestations {
+		attestationData, err := attestation.Data()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to obtain attestation data")
+		}
+		datas[i] = attestationData
+	}
+
+	minSlot, maxSlot := attestationSlotRange(chainTime, datas)
+
+	// Inclusion can only happen strictly after an attestation's own slot, and the
+	// protocol requires it within roughly an epoch, so the prefetch/search window
+	// needs to reach forward past maxSlot by about an epoch rather than marching
+	// all the way to the live chain head (which would pull every block body
+	// since minSlot into memory when evaluating an old batch of attestations).
+	inclusionMaxSlot := maxSlot + phase0.Slot(chainTime.SlotsPerEpoch())
+	if currentSlot := chainTime.CurrentSlot(); inclusionMaxSlot > currentSlot {
+		inclusionMaxSlot = currentSlot
+	}
+	if inclusionMaxSlot < maxSlot {
+		inclusionMaxSlot = maxSlot
+	}
+
+	canonicalRoots, err := prefetchCanonicalRoots(ctx, headersCache, minSlot, inclusionMaxSlot)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies, err := prefetchBlockBodies(ctx, bodiesCache, canonicalRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	// liveCanonicalRoot falls back to a live backwards walk via headersCache when
+	// the prefetched map doesn't reach far enough back to find a canonical
+	// ancestor for a given slot.
+	liveCanonicalRoot := func(slot phase0.Slot) (phase0.Root, error) {
+		return canonicalRootAtOrBefore(ctx, headersCache, slot)
+	}
+
+	evaluations := make([]AttestationEvaluation, len(attestations))
+	for i, attestationData := range datas {
+		targetSlot := chainTime.FirstSlotOfEpoch(attestationData.Target.Epoch)
+		sourceSlot := chainTime.FirstSlotOfEpoch(attestationData.Source.Epoch)
+
+		head, err := canonicalRootAtOrBeforeFromMap(canonicalRoots, attestationData.Slot, minSlot, liveCanonicalRoot)
+		if err != nil {
+			return nil, err
+		}
+		target, err := canonicalRootAtOrBeforeFromMap(canonicalRoots, targetSlot, minSlot, liveCanonicalRoot)
+		if err != nil {
+			return nil, err
+		}
+		source, err := canonicalRootAtOrBeforeFromMap(canonicalRoots, sourceSlot, minSlot, liveCanonicalRoot)
+		if err != nil {
+			return nil, err
+		}
+
+		delay, err := inclusionDelayFromMap(bodies, attestationData, inclusionMaxSlot)
+		if err != nil {
+			return nil, err
+		}
+
+		evaluations[i] = AttestationEvaluation{
+			HeadCorrect:    bytes.Equal(head[:], attestationData.BeaconBlockRoot[:]),
+			TargetCorrect:  bytes.Equal(target[:], attestationData.Target.Root[:]),
+			SourceCorrect:  bytes.Equal(source[:], attestationData.Source.Root[:]),
+			InclusionDelay: delay,
+		}
+	}
+
+	return evaluations, nil
+}
+
+// attestationSlotRange calculates the range of slots that need canonical header
+// coverage in order to evaluate every attestation in the batch.
+func attestationSlotRange(chainTime chaintime.Service, datas []*phase0.AttestationData) (phase0.Slot, phase0.Slot) {
+	minSlot := datas[0].Slot
+	maxSlot := datas[0].Slot
+
+	for _, attestationData := range datas {
+		if attestationData.Slot < minSlot {
+			minSlot = attestationData.Slot
+		}
+		if attestationData.Slot > maxSlot {
+			maxSlot = attestationData.Slot
+		}
+
+		targetSlot := chainTime.FirstSlotOfEpoch(attestationData.Target.Epoch)
+		if targetSlot < minSlot {
+			minSlot = targetSlot
+		}
+
+		sourceSlot := chainTime.FirstSlotOfEpoch(attestationData.Source.Epoch)
+		if sourceSlot < minSlot {
+			minSlot = sourceSlot
+		}
+	}
+
+	return minSlot, maxSlot
+}
+
+// prefetchCanonicalRoots fetches every header in [minSlot,maxSlot] using a bounded
+// worker pool, and returns a map of canonical slot to block root.
+func prefetchCanonicalRoots(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	minSlot phase0.Slot,
+	maxSlot phase0.Slot,
+) (
+	map[phase0.Slot]phase0.Root,
+	error,
+) {
+	results := make(map[phase0.Slot]phase0.Root)
+
+	if err := runBoundedSlotRange(ctx, minSlot, maxSlot, func(slot phase0.Slot, mu *sync.Mutex) error {
+		header, err := headersCache.Fetch(ctx, slot)
+		if err != nil {
+			return err
+		}
+		if header == nil || !header.Canonical {
+			return nil
+		}
+
+		mu.Lock()
+		results[slot] = header.Root
+		mu.Unlock()
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// prefetchBlockBodies fetches the block body for every canonical slot found by
+// prefetchCanonicalRoots, using a bounded worker pool.
+func prefetchBlockBodies(ctx context.Context,
+	bodiesCache *BeaconBlockBodyCache,
+	canonicalRoots map[phase0.Slot]phase0.Root,
+) (
+	map[phase0.Slot]*spec.VersionedSignedBeaconBlock,
+	error,
+) {
+	results := make(map[phase0.Slot]*spec.VersionedSignedBeaconBlock, len(canonicalRoots))
+
+	slots := make([]phase0.Slot, 0, len(canonicalRoots))
+	for slot := range canonicalRoots {
+		slots = append(slots, slot)
+	}
+
+	var mu sync.Mutex
+	if err := runBoundedSlots(ctx, slots, func(slot phase0.Slot) error {
+		body, err := bodiesCache.Fetch(ctx, slot)
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			return nil
+		}
+
+		mu.Lock()
+		results[slot] = body
+		mu.Unlock()
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// runBoundedSlotRange runs fn for every slot in [minSlot,maxSlot] using a bounded
+// worker pool, returning the first error encountered (if any).
+func runBoundedSlotRange(ctx context.Context, minSlot phase0.Slot, maxSlot phase0.Slot, fn func(phase0.Slot, *sync.Mutex) error) error {
+	slots := make([]phase0.Slot, 0, int(maxSlot-minSlot)+1)
+	for slot := minSlot; slot <= maxSlot; slot++ {
+		slots = append(slots, slot)
+	}
+
+	var mu sync.Mutex
+
+	return runBoundedSlots(ctx, slots, func(slot phase0.Slot) error {
+		return fn(slot, &mu)
+	})
+}
+
+// runBoundedSlots runs fn for every slot in slots using a bounded worker pool,
+// returning the first error encountered (if any) and respecting context cancellation.
+func runBoundedSlots(ctx context.Context, slots []phase0.Slot, fn func(phase0.Slot) error) error {
+	slotCh := make(chan phase0.Slot)
+	errCh := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < headerPrefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for slot := range slotCh {
+				if err := fn(slot); err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, slot := range slots {
+		select {
+		case slotCh <- slot:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(slotCh)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+
+	return ctx.Err()
+}
+
+// canonicalRootAtOrBeforeFromMap walks the prefetched canonical-slot map backwards from
+// slot, down to minSlot, to find the first canonical root. minSlot is only the edge of
+// the batch's prefetch window, not necessarily genesis: the earliest epoch-boundary slot
+// in the batch may itself be a missed/non-canonical slot, in which case the real
+// canonical ancestor lies further back than anything that was prefetched. When the map
+// is exhausted before a match is found, fall back to a live walk (the same primitive
+// AttestationHead/Target/Source use) rather than conflating "ran out of prefetched data"
+// with ErrNoCanonicalAncestor.
+func canonicalRootAtOrBeforeFromMap(
+	canonicalRoots map[phase0.Slot]phase0.Root,
+	slot phase0.Slot,
+	minSlot phase0.Slot,
+	liveFallback func(phase0.Slot) (phase0.Root, error),
+) (
+	phase0.Root,
+	error,
+) {
+	for {
+		if root, exists := canonicalRoots[slot]; exists {
+			return root, nil
+		}
+		if slot <= minSlot {
+			break
+		}
+		slot--
+	}
+
+	if minSlot == 0 {
+		return phase0.Root{}, ErrNoCanonicalAncestor
+	}
+
+	return liveFallback(minSlot - 1)
+}
+
+// inclusionDelayFromMap returns the inclusion delay for the given attestation using
+// only the prefetched canonical-slot and block-body maps, or AttestationNotIncluded
+// if no inclusion is found within the prefetched range.
+func inclusionDelayFromMap(
+	bodies map[phase0.Slot]*spec.VersionedSignedBeaconBlock,
+	attestationData *phase0.AttestationData,
+	maxSlot phase0.Slot,
+) (
+	int,
+	error,
+) {
+	for slot := attestationData.Slot + 1; slot <= maxSlot; slot++ {
+		body, exists := bodies[slot]
+		if !exists || body == nil {
+			continue
+		}
+
+		included, err := bodyIncludesAttestation(body, attestationData)
+		if err != nil {
+			return 0, err
+		}
+		if included {
+			return int(slot - attestationData.Slot), nil
+		}
+	}
+
+	return AttestationNotIncluded, nil
+}
@@ -0,0 +1,108 @@
+// Copyright © 2022 Weald Technology Trading.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalRootAtOrBeforeFromMap(t *testing.T) {
+	wantRoot := phase0.Root{0x01}
+	fallbackRoot := phase0.Root{0x02}
+
+	tests := []struct {
+		name           string
+		canonicalRoots map[phase0.Slot]phase0.Root
+		slot           phase0.Slot
+		minSlot        phase0.Slot
+		wantRoot       phase0.Root
+		wantFallback   bool
+		wantErr        error
+	}{
+		{
+			// Common case: the slot itself is in the prefetched map.
+			name:           "hit",
+			canonicalRoots: map[phase0.Slot]phase0.Root{10: wantRoot},
+			slot:           10,
+			minSlot:        8,
+			wantRoot:       wantRoot,
+		},
+		{
+			// The slot is missed, but an earlier canonical slot within the prefetch
+			// window covers it.
+			name:           "walk within window",
+			canonicalRoots: map[phase0.Slot]phase0.Root{8: wantRoot},
+			slot:           10,
+			minSlot:        8,
+			wantRoot:       wantRoot,
+		},
+		{
+			// The batch's earliest epoch-boundary slot (minSlot) is itself a missed
+			// slot, so the real canonical ancestor lies outside the prefetched
+			// window. This must fall back to a live walk rather than returning
+			// ErrNoCanonicalAncestor, even though a canonical ancestor does exist.
+			name:           "missed epoch boundary falls back instead of erroring",
+			canonicalRoots: map[phase0.Slot]phase0.Root{},
+			slot:           8,
+			minSlot:        8,
+			wantFallback:   true,
+			wantRoot:       fallbackRoot,
+		},
+		{
+			// minSlot is genesis, so there is nowhere further back to fall back to.
+			name:           "genesis with no match is a hard error",
+			canonicalRoots: map[phase0.Slot]phase0.Root{},
+			slot:           0,
+			minSlot:        0,
+			wantErr:        ErrNoCanonicalAncestor,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fallbackCalled := false
+			fallback := func(slot phase0.Slot) (phase0.Root, error) {
+				fallbackCalled = true
+				require.Equal(t, test.minSlot-1, slot)
+
+				return fallbackRoot, nil
+			}
+
+			root, err := canonicalRootAtOrBeforeFromMap(test.canonicalRoots, test.slot, test.minSlot, fallback)
+
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantRoot, root)
+			require.Equal(t, test.wantFallback, fallbackCalled)
+		})
+	}
+}
+
+func TestInclusionDelayFromMap(t *testing.T) {
+	attestationData := &phase0.AttestationData{Slot: 10}
+
+	t.Run("not included within range", func(t *testing.T) {
+		delay, err := inclusionDelayFromMap(map[phase0.Slot]*spec.VersionedSignedBeaconBlock{}, attestationData, 12)
+		require.NoError(t, err)
+		require.Equal(t, AttestationNotIncluded, delay)
+	})
+}
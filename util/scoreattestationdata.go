@@ -0,0 +1,83 @@
+// Copyright © 2022 Weald Technology Trading.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"math"
+
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/wealdtech/ethdo/services/chaintime"
+)
+
+// ScoreAttestationData generates a score for attestation data, to allow comparison of
+// attestation data values from multiple beacon nodes. This follows the "best attestation
+// data" strategy used by Vouch's attestationdata strategy: the score is the sum of the
+// source and target epochs, plus a bonus for voting for the correct head that decays
+// with the distance between the attestation's slot and the slot of the canonical block
+// that the attestation names as its head.
+//
+// It returns NaN if the beacon block root named by the attestation data cannot be
+// resolved to a canonical block.
+func ScoreAttestationData(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	chainTime chaintime.Service,
+	attestationData *phase0.AttestationData,
+) (
+	float64,
+	error,
+) {
+	matchSlot, found, err := canonicalSlotForRoot(ctx, headersCache, attestationData.Slot, attestationData.BeaconBlockRoot)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return math.NaN(), nil
+	}
+
+	// Only a vote for the canonical head at the attestation's slot earns the bonus.
+	head, err := canonicalRootAtOrBefore(ctx, headersCache, attestationData.Slot)
+	if err != nil {
+		return 0, err
+	}
+	headBonus := 0.0
+	if bytes.Equal(head[:], attestationData.BeaconBlockRoot[:]) {
+		distance := float64(attestationData.Slot - matchSlot)
+		headBonus = math.Max(0, 0.5-0.1*distance)
+	}
+
+	return float64(attestationData.Source.Epoch) + float64(attestationData.Target.Epoch) + headBonus, nil
+}
+
+// canonicalSlotForRoot walks canonical blocks backwards from startSlot, looking for the
+// one whose root matches the supplied root, reusing the same canonicalAncestor primitive
+// as AttestationHead. It returns false if no canonical block with a matching root is
+// found, rather than ErrNoCanonicalAncestor, since ScoreAttestationData treats an
+// unresolved head root as NaN rather than a hard error.
+func canonicalSlotForRoot(ctx context.Context,
+	headersCache *BeaconBlockHeaderCache,
+	startSlot phase0.Slot,
+	root phase0.Root,
+) (
+	phase0.Slot,
+	bool,
+	error,
+) {
+	_, slot, ok, err := canonicalAncestor(ctx, headersCache, startSlot, func(candidate phase0.Root) bool {
+		return bytes.Equal(candidate[:], root[:])
+	})
+
+	return slot, ok, err
+}